@@ -4,29 +4,100 @@ import (
 	"io"
 	"os"
 	"fmt"
+	"bytes"
 	"errors"
 	"strings"
 	"archive/tar"
+	"archive/zip"
 	"compress/gzip"
 	"path/filepath"
+	"github.com/klauspost/compress/zstd"
 	log "github.com/sirupsen/logrus"
 )
 
+// dicomPreambleOffset is the offset, in bytes, at which the "DICM" magic
+// is found in a DICOM Part 10 file, right after the 128-byte preamble.
+const dicomPreambleOffset = 128
+
+// dicomMagic is the 4-byte magic string marking a DICOM Part 10 file.
+var dicomMagic = []byte("DICM")
+
 // Extractor is an interface defining the methods for extracting an archive file.
 type Extractor interface {
 	Extract(pathArchive string) (string, error)
 }
 
 // GetDicomExtractor returns the DicomExtractor implementation based on the
-// given path.  The selection is made based on the suffix of the path.
+// given path.  The selection is made by sniffing the content of the file
+// for known magic bytes, falling back to the suffix of the path when the
+// content is inconclusive (e.g. the file is empty or not yet flushed).
 func GetDicomExtractor(path string) (Extractor) {
-	if strings.HasSuffix(path, ".tar.gz") {
-		return &DicomExtractorTgz{}
+	format, err := DetectFormat(path)
+	if err != nil {
+		log.Warn(fmt.Sprintf("cannot sniff format of %s, falling back to suffix: %s", path, err))
+		return extractorForSuffix(path)
+	}
+	if e := extractorForFormat(format); e != nil {
+		return e
+	}
+	return extractorForSuffix(path)
+}
+
+// extractFirstRegularFromTar walks tr, extracting the first regular file it
+// contains into dir.  desc names the archive for error messages -- a local
+// path when tr was decompressed from a file already on disk, or the iRODS
+// path when tr is being consumed straight off the wire by streamExtractTar.
+// It is shared by DicomExtractorTgz, DicomExtractorZstd and
+// streamExtractTar, which only differ in how tr's underlying reader is
+// produced.
+func extractFirstRegularFromTar(tr *tar.Reader, dir, desc string) (string, error) {
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return "", errors.New("empty archive: " + desc)
+		}
+		if err != nil {
+			return "", err
+		}
+		if h.Typeflag == tar.TypeDir {
+			continue
+		}
+		if h.Typeflag == tar.TypeReg {
+			// output file
+			fdicom := filepath.Join(dir, filepath.Base(h.Name))
+
+			if err := copyReaderToPath(tr, fdicom, os.FileMode(h.Mode)); err != nil {
+				return "", err
+			}
+
+			log.Debug(fmt.Sprintf("DICOM file extracted: %s", fdicom))
+			return fdicom, nil
+		}
 	}
-	if strings.HasSuffix(path, ".zip") {
-		return &DicomExtractorZip{}
+}
+
+// streamExtractTar decompresses r, a gzip or zstd stream as delivered by
+// IRODSBackend.Get, and extracts the first regular file it
+// contains into dir without ever writing the compressed archive itself to
+// disk.  format must be FormatGzip or FormatZstd.
+func streamExtractTar(format Format, r io.Reader, dir, desc string) (string, error) {
+	switch format {
+	case FormatGzip:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return "", err
+		}
+		defer gz.Close()
+		return extractFirstRegularFromTar(tar.NewReader(gz), dir, desc)
+	case FormatZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return "", err
+		}
+		defer zr.Close()
+		return extractFirstRegularFromTar(tar.NewReader(zr), dir, desc)
 	}
-	return &DicomExtractorIgnore{}
+	return "", fmt.Errorf("streamExtractTar: unsupported format for %s", desc)
 }
 
 // DicomExtractorTgz implements the Extractor interface for the gzipped-tar archive.
@@ -44,7 +115,6 @@ func (DicomExtractorTgz) Extract(pathArchive string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	tr := tar.NewReader(a)
 
 	defer func() {
 		a.Close()
@@ -52,30 +122,32 @@ func (DicomExtractorTgz) Extract(pathArchive string) (string, error) {
 		os.Remove(pathArchive)
 	}()
 
-	dir := filepath.Dir(pathArchive)
-
-	// extracted dicom filename
-	var fdicom string
-	for {
-		h, err := tr.Next()
-		if err == io.EOF {
-			return "", errors.New("empty archive: " + pathArchive)
-		}
-		if h.Typeflag == tar.TypeDir {
-			continue
-		}
-		if h.Typeflag == tar.TypeReg {
-			// output file
-			fdicom = filepath.Join(dir, filepath.Base(h.Name))
+	return extractFirstRegularFromTar(tar.NewReader(a), filepath.Dir(pathArchive), pathArchive)
+}
 
-			if err := copyReaderToPath(tr, fdicom, os.FileMode(h.Mode)); err != nil {
-				return "", err
-			}
+// DicomExtractorZstd implements the Extractor interface for the zstd-compressed tar
+// archive ('tar.zst').  It extracts the first DICOM file from the archive, and stores
+// the extracted file in a directory the same as the zstd file.
+type DicomExtractorZstd struct {}
+func (DicomExtractorZstd) Extract(pathArchive string) (string, error) {
 
-			log.Debug(fmt.Sprintf("DICOM file extracted: %s", fdicom))
-			return fdicom, nil
-		}
+	// open the zstd-compressed archive: file -> zstd -> tar
+	f, err := os.Open(pathArchive)
+	if err != nil {
+		return "", err
+	}
+	a, err := zstd.NewReader(f)
+	if err != nil {
+		return "", err
 	}
+
+	defer func() {
+		a.Close()
+		f.Close()
+		os.Remove(pathArchive)
+	}()
+
+	return extractFirstRegularFromTar(tar.NewReader(a), filepath.Dir(pathArchive), pathArchive)
 }
 
 // DicomExtractorIgnore implements the Extractor interface for ignoring extracting files from the archive.
@@ -84,8 +156,71 @@ func (DicomExtractorIgnore) Extract(pathArchive string) (string, error) {
 	return pathArchive, nil
 }
 
-// DicomExtractorIgnore implements the Extractor interface for extracting DICOM files from a zip file.
+// DicomExtractorZip implements the Extractor interface for the zip archive.
+// It extracts the first DICOM file from the archive, and stores the extracted
+// file in a directory the same as the zip file.
 type DicomExtractorZip struct {}
 func (DicomExtractorZip) Extract(pathArchive string) (string, error) {
-	return pathArchive, nil
+
+	r, err := zip.OpenReader(pathArchive)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		r.Close()
+		os.Remove(pathArchive)
+	}()
+
+	dir := filepath.Dir(pathArchive)
+
+	for _, zf := range r.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		if strings.ToUpper(filepath.Base(zf.Name)) == "DICOMDIR" {
+			continue
+		}
+		if !looksLikeDicom(zf) {
+			continue
+		}
+
+		rc, err := zf.Open()
+		if err != nil {
+			return "", err
+		}
+
+		fdicom := filepath.Join(dir, filepath.Base(zf.Name))
+		err = copyReaderToPath(rc, fdicom, zf.Mode())
+		rc.Close()
+		if err != nil {
+			return "", err
+		}
+
+		log.Debug(fmt.Sprintf("DICOM file extracted: %s", fdicom))
+		return fdicom, nil
+	}
+
+	return "", errors.New("no DICOM file found in archive: " + pathArchive)
+}
+
+// looksLikeDicom tells whether the given zip entry looks like a DICOM instance,
+// either by its file extension, or by sniffing the 128-byte preamble followed
+// by the "DICM" magic at offset 128.
+func looksLikeDicom(zf *zip.File) bool {
+	ext := strings.ToUpper(filepath.Ext(zf.Name))
+	if ext == ".IMA" || ext == ".DCM" {
+		return true
+	}
+
+	rc, err := zf.Open()
+	if err != nil {
+		return false
+	}
+	defer rc.Close()
+
+	buf := make([]byte, dicomPreambleOffset+len(dicomMagic))
+	if _, err := io.ReadFull(rc, buf); err != nil {
+		return false
+	}
+	return bytes.Equal(buf[dicomPreambleOffset:], dicomMagic)
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+)
+
+// Format identifies the on-disk encoding of a downloaded data object, as
+// determined by sniffing its leading bytes.
+type Format int
+
+const (
+	// FormatUnknown is returned when none of the known magic bytes match.
+	FormatUnknown Format = iota
+	// FormatGzip marks a gzip-compressed stream (e.g. a 'tar.gz' bundle).
+	FormatGzip
+	// FormatZip marks a zip archive.
+	FormatZip
+	// FormatZstd marks a zstd-compressed stream (e.g. a 'tar.zst' bundle).
+	FormatZstd
+	// FormatDicom marks a raw DICOM Part 10 instance.
+	FormatDicom
+)
+
+// sniffLen is the number of leading bytes read from a file to detect its format.
+const sniffLen = 512
+
+// magic byte sequences used to detect a format from its leading bytes.
+var (
+	magicGzip = []byte{0x1f, 0x8b, 0x08}
+	magicZip  = []byte{0x50, 0x4b, 0x03, 0x04}
+	magicZstd = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// DetectFormat peeks at the first bytes of the file at path and returns the
+// Format it matches, or FormatUnknown if none of the known magic bytes are
+// found.  This is more robust than suffix matching against iRODS objects
+// that may carry odd or double extensions.
+func DetectFormat(path string) (Format, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return FormatUnknown, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return FormatUnknown, err
+	}
+	return detectFormatBytes(buf[:n]), nil
+}
+
+// detectFormatBytes is the magic-byte matching at the core of DetectFormat,
+// factored out so the streaming download path in downloadAndExtract can
+// sniff a peeked buffer without needing a file on disk.
+func detectFormatBytes(buf []byte) Format {
+	switch {
+	case bytes.HasPrefix(buf, magicGzip):
+		return FormatGzip
+	case bytes.HasPrefix(buf, magicZip):
+		return FormatZip
+	case bytes.HasPrefix(buf, magicZstd):
+		return FormatZstd
+	case len(buf) >= dicomPreambleOffset+len(dicomMagic) &&
+		bytes.Equal(buf[dicomPreambleOffset:dicomPreambleOffset+len(dicomMagic)], dicomMagic):
+		return FormatDicom
+	}
+	return FormatUnknown
+}
+
+// extractorForFormat maps a detected Format to its Extractor implementation.
+func extractorForFormat(f Format) Extractor {
+	switch f {
+	case FormatGzip:
+		return &DicomExtractorTgz{}
+	case FormatZip:
+		return &DicomExtractorZip{}
+	case FormatZstd:
+		return &DicomExtractorZstd{}
+	case FormatDicom:
+		// a raw DICOM instance is already the file we want; downloadDicom
+		// handles relocating it to the session folder via isRawDicom.
+		return &DicomExtractorIgnore{}
+	}
+	return nil
+}
+
+// extractorForSuffix is the suffix-based fallback used when content sniffing
+// is inconclusive (e.g. a truncated or empty download).
+func extractorForSuffix(path string) Extractor {
+	if strings.HasSuffix(path, ".tar.gz") {
+		return &DicomExtractorTgz{}
+	}
+	if strings.HasSuffix(path, ".zip") {
+		return &DicomExtractorZip{}
+	}
+	if strings.HasSuffix(path, ".tar.zst") {
+		return &DicomExtractorZstd{}
+	}
+	return &DicomExtractorIgnore{}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// IRODSBackend abstracts how this tool talks to iRODS, so the query/download
+// pipeline in getOneDicom/downloadDicom doesn't care whether it is shelling
+// out to the icommands (iquest/iget), or speaking the iRODS protocol
+// natively.  Select the implementation via --backend.
+type IRODSBackend interface {
+	// QueryCollections streams the subject/session collection paths under ns
+	// whose name contains datePattern, deduplicated to one per subject/session.
+	QueryCollections(ctx context.Context, ns, datePattern string) (<-chan string, error)
+	// QueryFiles lists the data objects, with their dedup-cache metadata, in
+	// the given collection.
+	QueryFiles(ctx context.Context, collection string) ([]irodsFile, error)
+	// Get downloads dataObj from iRODS.  If w is non-nil, its bytes are
+	// streamed into w and nothing is left at localPath: nativeBackend never
+	// writes it, while icommandsBackend uses it as a scratch file and
+	// removes it afterwards.  This lets downloadAndExtract pull a tar-based
+	// archive straight into the extractor.  If w is nil, dataObj is written
+	// to localPath as usual.
+	Get(ctx context.Context, dataObj, localPath string, w io.Writer) error
+	// Close releases any resource (connections, pools, ...) held by the backend.
+	Close() error
+}
+
+// newIRODSBackend returns the IRODSBackend selected by --backend.
+func newIRODSBackend() (IRODSBackend, error) {
+	switch *opts_backend {
+	case "icommands":
+		return &icommandsBackend{}, nil
+	case "native":
+		return newNativeBackend()
+	default:
+		return nil, fmt.Errorf("unknown --backend %q, want \"icommands\" or \"native\"", *opts_backend)
+	}
+}
+
+// icommandsBackend is the original implementation: it forks the iquest and
+// iget icommands per collection and per file via runIRODS.  It requires the
+// icommands package to be installed on the host, and is kept as the default,
+// battle-tested fallback for the nativeBackend.
+type icommandsBackend struct{}
+
+// QueryCollections runs the 'iquest' LIKE query on COLL_NAME, the same query
+// getOneDicom has always run, deduplicating collections that belong to the
+// same subject/session, and retrying transient failures via runIRODS.
+func (icommandsBackend) QueryCollections(ctx context.Context, ns, datePattern string) (<-chan string, error) {
+	query := "SELECT COLL_NAME WHERE COLL_NAME LIKE '" + ns + "/%" + datePattern + "%'"
+	st, err := runIRODS(ctx, "iquest", "--no-page", "%s", query)
+	if err != nil {
+		// CAT_NO_ROWS_FOUND just means no subject/session matched
+		// datePattern yet, a routine condition for e.g. a daily cron run
+		// rather than a failure worth surfacing.
+		if strings.Contains(statusMessage(st), "CAT_NO_ROWS_FOUND") {
+			out := make(chan string)
+			close(out)
+			return out, nil
+		}
+		return nil, err
+	}
+
+	out := make(chan string, 2*MAX_DOWNLOAD_W)
+	collMap := make(map[string]bool)
+
+	go func() {
+		for _, line := range st.Stdout {
+			if matched, _ := regexp.MatchString("[0-9]{3}-.*", line); matched {
+				// the collection contains series id. In this case, we
+				// check if the same subject/session has been visited, and
+				// only account the collection hasn't been visited before.
+				if !collMap[filepath.Dir(line)] {
+					collMap[filepath.Dir(line)] = true
+					out <- line
+				}
+				continue
+			}
+			out <- line
+		}
+		log.Debug("chanColls closed")
+		close(out)
+	}()
+
+	return out, nil
+}
+
+// QueryFiles runs an 'iquest' query for the data objects of collection,
+// along with their checksum, modify time and size, retrying transient
+// failures via runIRODS.
+func (icommandsBackend) QueryFiles(ctx context.Context, collection string) ([]irodsFile, error) {
+	qryf := "SELECT COLL_NAME,DATA_NAME,DATA_CHECKSUM,DATA_MODIFY_TIME,DATA_SIZE WHERE COLL_NAME = '" + collection + "'"
+	log.Debug(qryf)
+	st, err := runIRODS(ctx, "iquest", "--no-page", "%s/%s"+irodsFileSep+"%s"+irodsFileSep+"%s"+irodsFileSep+"%s", qryf)
+	if err != nil {
+		// CAT_NO_ROWS_FOUND just means the collection has no data objects
+		// yet, a routine condition rather than a failure worth surfacing.
+		if strings.Contains(statusMessage(st), "CAT_NO_ROWS_FOUND") {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var files []irodsFile
+	for _, l := range st.Stdout {
+		f, err := parseIrodsFile(l)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// Get fetches dataObj via 'iget', retrying transient failures via runIRODS.
+// iget only ever writes to disk, so when w is non-nil this fetches to
+// localPath as normal and then copies it into w, removing localPath
+// afterwards -- still correct, just without the native backend's no-disk
+// streaming benefit.
+func (icommandsBackend) Get(ctx context.Context, dataObj, localPath string, w io.Writer) error {
+	if _, err := runIRODS(ctx, "iget", "-f", dataObj, localPath); err != nil {
+		return err
+	}
+	if w == nil {
+		return nil
+	}
+
+	defer os.Remove(localPath)
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Close is a no-op: icommandsBackend holds no long-lived resources.
+func (icommandsBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dedupCacheFile is the name of the JSON file, within --cache-dir, holding the
+// dedup cache entries.
+const dedupCacheFile = "cache.json"
+
+// dedupCacheEntry records that the iRODS data object identified by Path,
+// Checksum and Mtime has already been downloaded/extracted to LocalPath, and
+// the sha256 of that file.  lookup matches an entry on Checksum and Mtime,
+// and gc prunes it when LocalPath is gone; neither compares Sha256.
+type dedupCacheEntry struct {
+	Checksum  string `json:"checksum"`
+	Mtime     string `json:"mtime"`
+	LocalPath string `json:"local_path"`
+	Sha256    string `json:"sha256"`
+}
+
+// dedupCache is a persistent, JSON-file-backed cache keyed by the iRODS
+// (COLL_NAME, DATA_NAME) path, recording the checksum/mtime it was
+// downloaded at, so that repeat runs over overlapping date windows can skip
+// re-downloading and re-extracting a data object that hasn't changed.
+type dedupCache struct {
+	path    string
+	mutex   sync.Mutex
+	entries map[string]dedupCacheEntry
+}
+
+// defaultCacheDir returns $XDG_CACHE_HOME/dicom-dr-tools (or the platform
+// equivalent via os.UserCacheDir), used as the default --cache-dir.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "dicom-dr-tools")
+	}
+	return filepath.Join(dir, "dicom-dr-tools")
+}
+
+// loadDedupCache reads the dedup cache from dir, returning an empty cache if
+// it doesn't exist yet.
+func loadDedupCache(dir string) (*dedupCache, error) {
+	c := &dedupCache{
+		path:    filepath.Join(dir, dedupCacheFile),
+		entries: make(map[string]dedupCacheEntry),
+	}
+
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		return nil, fmt.Errorf("corrupt dedup cache %s: %w", c.path, err)
+	}
+	return c, nil
+}
+
+// lookup returns the local path previously extracted for the iRODS object at
+// path, provided the checksum and mtime still match and the local file still
+// exists on disk.
+func (c *dedupCache) lookup(path, checksum, mtime string) (string, bool) {
+	c.mutex.Lock()
+	e, ok := c.entries[path]
+	c.mutex.Unlock()
+
+	if !ok || e.Checksum != checksum || e.Mtime != mtime {
+		return "", false
+	}
+	if _, err := os.Stat(e.LocalPath); err != nil {
+		return "", false
+	}
+	return e.LocalPath, true
+}
+
+// store records that the iRODS object at path, with the given checksum and
+// mtime, has been extracted to localPath, and flushes the cache to disk.
+func (c *dedupCache) store(path, checksum, mtime, localPath string) error {
+	sum, err := sha256File(localPath)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.entries[path] = dedupCacheEntry{Checksum: checksum, Mtime: mtime, LocalPath: localPath, Sha256: sum}
+	c.mutex.Unlock()
+
+	return c.flush()
+}
+
+// flush writes the cache to its JSON file on disk.
+func (c *dedupCache) flush() error {
+	c.mutex.Lock()
+	data, err := json.MarshalIndent(c.entries, "", "  ")
+	c.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, data, 0644)
+}
+
+// gc walks the cache and removes entries whose local file no longer exists
+// on disk, then flushes the result.  It returns the number of entries pruned.
+func (c *dedupCache) gc() (int, error) {
+	c.mutex.Lock()
+	pruned := 0
+	for path, e := range c.entries {
+		if _, err := os.Stat(e.LocalPath); err != nil {
+			log.Debug(fmt.Sprintf("pruning stale cache entry: %s -> %s", path, e.LocalPath))
+			delete(c.entries, path)
+			pruned++
+		}
+	}
+	c.mutex.Unlock()
+
+	if pruned > 0 {
+		if err := c.flush(); err != nil {
+			return pruned, err
+		}
+	}
+	return pruned, nil
+}
+
+// sha256File returns the hex-encoded sha256 checksum of the file at path.
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
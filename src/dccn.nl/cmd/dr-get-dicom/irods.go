@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/go-cmd/cmd"
+	log "github.com/sirupsen/logrus"
+)
+
+// transientErrorSignatures lists substrings of iRODS error messages that are
+// known to be transient (agent hiccup, momentary catalog lock, network blip),
+// and therefore worth retrying.
+var transientErrorSignatures = []string{
+	"SYS_HEADER_READ_LEN_ERR",
+	"USER_SOCK_CONNECT_ERR",
+	"CAT_STATEMENT_TABLE_FULL",
+	"i/o timeout",
+	"connection reset by peer",
+}
+
+// permanentErrorSignatures lists substrings of iRODS error messages that
+// indicate a permanent failure (e.g. a permission problem) that retrying
+// will never fix.
+var permanentErrorSignatures = []string{
+	"CAT_NO_ACCESS_PERMISSION",
+	"CAT_NO_ROWS_FOUND",
+}
+
+const (
+	// retryBaseDelay is the backoff delay after the first failed attempt.
+	retryBaseDelay = 500 * time.Millisecond
+	// retryMaxDelay caps the exponential backoff between retries.
+	retryMaxDelay = 30 * time.Second
+)
+
+// isTransientIRODSError tells whether msg matches one of the known transient
+// error signatures.
+func isTransientIRODSError(msg string) bool {
+	for _, sig := range transientErrorSignatures {
+		if strings.Contains(msg, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPermanentIRODSError tells whether msg matches one of the known permanent
+// error signatures, which should never be retried.
+func isPermanentIRODSError(msg string) bool {
+	for _, sig := range permanentErrorSignatures {
+		if strings.Contains(msg, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+// backoffDuration returns the delay to wait before the (attempt+1)-th retry,
+// exponentially increasing with attempt and capped at retryMaxDelay, then
+// randomly jittered down to between 50% and 100% of that value to avoid a
+// thundering herd of retrying workers.
+func backoffDuration(attempt int) time.Duration {
+	d := retryBaseDelay * time.Duration(uint64(1)<<uint(attempt))
+	if d <= 0 || d > retryMaxDelay {
+		d = retryMaxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// statusMessage renders the stderr output and error of a finished command
+// into a single string suitable for error-signature matching.
+func statusMessage(st cmd.Status) string {
+	msg := strings.Join(st.Stderr, "\n")
+	if st.Error != nil {
+		if msg != "" {
+			msg += ": "
+		}
+		msg += st.Error.Error()
+	}
+	return msg
+}
+
+// runIRODS runs the named iRODS command (iquest, iget, ...) with the given
+// arguments, retrying on transient error signatures with exponential backoff
+// and jitter.  Retries are capped by --max-retries and by the overall
+// --retry-timeout budget.  A permanent error signature (e.g.
+// CAT_NO_ACCESS_PERMISSION) is never retried.  The command, and any pending
+// retry wait, is aborted as soon as ctx is cancelled.
+func runIRODS(ctx context.Context, name string, args ...string) (cmd.Status, error) {
+	deadline := time.Now().Add(*opts_retry_timeout)
+
+	var st cmd.Status
+	for attempt := 0; ; attempt++ {
+		c := cmd.NewCmd(name, args...)
+		statusChan := c.Start()
+
+		select {
+		case st = <-statusChan:
+		case <-ctx.Done():
+			c.Stop()
+			return st, ctx.Err()
+		}
+
+		if st.Exit == 0 {
+			return st, nil
+		}
+
+		msg := statusMessage(st)
+		if isPermanentIRODSError(msg) {
+			return st, fmt.Errorf("%s: permanent error: %s", name, msg)
+		}
+		if !isTransientIRODSError(msg) || attempt >= *opts_max_retries || time.Now().After(deadline) {
+			return st, fmt.Errorf("%s: %s", name, msg)
+		}
+
+		wait := backoffDuration(attempt)
+		log.Warn(fmt.Sprintf("transient error from %s (attempt %d/%d), retrying in %s: %s", name, attempt+1, *opts_max_retries, wait, msg))
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return st, ctx.Err()
+		}
+	}
+}
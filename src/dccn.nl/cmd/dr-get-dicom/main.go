@@ -4,16 +4,15 @@ import (
 	"io"
 	"os"
 	"fmt"
-	"sync"
 	"flag"
 	"time"
-	"regexp"
+	"bufio"
 	"errors"
 	"strings"
-	"archive/tar"
-	"compress/gzip"
+	"strconv"
+	"context"
+	"os/signal"
 	"path/filepath"
-	"github.com/go-cmd/cmd"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -30,6 +29,13 @@ var DR_NS_COLLS = []string {"DAC_3055010.01_490","DAC_3010000.01_173"}
 var opts_date *string
 var opts_ddir *string
 var opts_verbose *bool
+var opts_max_retries *int
+var opts_retry_timeout *time.Duration
+var opts_no_progress *bool
+var opts_cache_dir *string
+var opts_force *bool
+var opts_gc *bool
+var opts_backend *string
 
 func init() {
 	y, m, d := time.Now().Date()
@@ -37,6 +43,13 @@ func init() {
 	opts_date = flag.String("t", today, "specify the date string in format YYYYmmdd")
 	opts_ddir = flag.String("d", "/project/3055010.01", "specify the local `path` for storing the downloaded raw data")
 	opts_verbose = flag.Bool("v", false, "set to print debug messages")
+	opts_max_retries = flag.Int("max-retries", 5, "specify the maximum number of retries for a transiently-failing iquest/iget command")
+	opts_retry_timeout = flag.Duration("retry-timeout", 2*time.Minute, "specify the maximum total `duration` allowed for retrying a single iquest/iget command")
+	opts_no_progress = flag.Bool("no-progress", false, "disable the interactive progress bars and fall back to plain log lines")
+	opts_cache_dir = flag.String("cache-dir", defaultCacheDir(), "specify the `directory` for storing the content-hash dedup cache")
+	opts_force = flag.Bool("force", false, "bypass the dedup cache and re-download/re-extract every file")
+	opts_gc = flag.Bool("gc", false, "prune dedup cache entries whose local file no longer exists, then exit")
+	opts_backend = flag.String("backend", "icommands", "specify the iRODS `backend` to use: \"icommands\" or \"native\"")
 	flag.Usage = usage
 	flag.Parse()
 
@@ -58,10 +71,46 @@ func usage() {
 }
 
 func main() {
+	cache, err := loadDedupCache(*opts_cache_dir)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("cannot load dedup cache: %s", err))
+	}
+
+	if *opts_gc {
+		pruned, err := cache.gc()
+		if err != nil {
+			log.Fatal(fmt.Sprintf("cannot prune dedup cache: %s", err))
+		}
+		log.Info(fmt.Sprintf("pruned %d stale entries from %s", pruned, *opts_cache_dir))
+		return
+	}
+
+	backend, err := newIRODSBackend()
+	if err != nil {
+		log.Fatal(fmt.Sprintf("cannot set up iRODS backend: %s", err))
+	}
+	defer backend.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// cancel in-flight downloads on Ctrl-C so they abort cleanly instead of
+	// leaving partially-written files behind.
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt)
+	go func() {
+		<-sigChan
+		log.Warn("interrupted, cancelling in-flight downloads ...")
+		cancel()
+	}()
+
 	for _,coll := range DR_NS_COLLS {
+		if ctx.Err() != nil {
+			break
+		}
 		log.Debug(fmt.Sprintf("checking %s ...", coll))
 		ns_coll := filepath.Join(DR_NS_DCCN, coll, "raw")
-		chanDicoms := getOneDicom(ns_coll)
+		chanDicoms := getOneDicom(ctx, backend, cache, ns_coll)
 		for f := range chanDicoms {
 			log.Info(f)
 		}
@@ -75,61 +124,27 @@ func main() {
 // files are pushed.
 //
 // This function uses go routines for performing query and downloading actions concurrently.  The
-// level of concurrency is confined by the constant MAX_DOWNLOAD_W.
-func getOneDicom(ns_coll string) (chan string) {
-
-	// define the query
-	query := "SELECT COLL_NAME WHERE COLL_NAME LIKE '" + ns_coll + "/%" + *opts_date + "%'"
-
-	// Disable output buffering, enable streaming
-	o := cmd.Options{
-		Buffered:  false,
-		Streaming: true,
+// level of concurrency is confined by the constant MAX_DOWNLOAD_W.  Cancelling ctx aborts the
+// query and download goroutines, and any in-flight retry, cleanly.  The cache is consulted
+// before, and updated after, every download so that repeat runs can skip unchanged files.
+// Querying and downloading are delegated to backend, so the pipeline itself doesn't care
+// whether iRODS is reached by forking icommands or over a native protocol connection.
+func getOneDicom(ctx context.Context, backend IRODSBackend, cache *dedupCache, ns_coll string) (chan string) {
+
+	// reporter drives the interactive progress bars; it is a no-op when
+	// progress reporting is disabled or stderr is not a TTY.
+	reporter := newProgressReporter(MAX_DOWNLOAD_W)
+
+	chanColls, err := backend.QueryCollections(ctx, ns_coll, *opts_date)
+	if err != nil {
+		log.Error(err)
+		chanDicoms := make(chan string)
+		close(chanDicoms)
+		return chanDicoms
 	}
-	chanColls := make(chan string, 2*MAX_DOWNLOAD_W)
-	collMap := make(map[string]bool)
-	mutex := &sync.Mutex{}
-	iquestCmdC := cmd.NewCmdOptions(o, "iquest", "--no-page", "%s", query)
-
-	s := iquestCmdC.Start()
-	m := 0
-	go func() {
-		Loop:
-		for {
-			select {
-			case line := <-iquestCmdC.Stdout:
-				if m, _ := regexp.MatchString("[0-9]{3}-.*", line); m {
-					// the collection contains series id. In this case, we
-					// check if the same subject/session has been visited, and
-					// only account the collection hasn't been visited before.
-					if ! collMap[filepath.Dir(line)] {
-						mutex.Lock()
-						collMap[filepath.Dir(line)] = true
-						mutex.Unlock()
-						chanColls <- line
-					}
-					continue
-				}
-				chanColls <- line
-			case line := <-iquestCmdC.Stderr:
-				log.Error(line)
-			case st := <-s:
-				if st.Exit != 0 {
-					log.Error(st.Error)
-				}
-				m = 1
-			default:
-				if m == 1 && len(iquestCmdC.Stdout) == 0 && len(iquestCmdC.Stderr) == 0 {
-					break Loop
-				}
-			}
-		}
-		log.Debug("chanColls closed")
-		close(chanColls)
-	}()
 
 	// spin up workers to query files in individual collections
-	chanFiles := make(chan string, 2*MAX_DOWNLOAD_W)
+	chanFiles := make(chan irodsFile, 2*MAX_DOWNLOAD_W)
 	chanSync1 := make(chan byte)
 	for i := 0; i < MAX_DOWNLOAD_W ; i++ {
 		go func() {
@@ -138,25 +153,26 @@ func getOneDicom(ns_coll string) (chan string) {
 				if ! ok {
 					break
 				}
+				if ctx.Err() != nil {
+					continue
+				}
+				reporter.addCollection()
 
-				qryf := "SELECT COLL_NAME,DATA_NAME WHERE COLL_NAME = '" + c + "'"
-				log.Debug(qryf)
-	 			iquestCmdF := cmd.NewCmd("iquest", "--no-page", "%s/%s", qryf)
-				s := <-iquestCmdF.Start()
-				for _, l := range s.Stdout {
-					// this query contains no data
-					if strings.Contains(l,"CAT_NO_ROWS_FOUND") {
-						continue
-					}
+				files, err := backend.QueryFiles(ctx, c)
+				if err != nil {
+					log.Error(err)
+					continue
+				}
+				for _, f := range files {
 					// add 'zip' file to download, and continue with the next
 					// file in the same collection.
-					if isZipFile(l) {
-						chanFiles <- l
+					if isZipFile(f.Path) {
+						chanFiles <- f
 						continue
 					}
 					// for 'tar.gz' file or 'IMA' file, we take only one file
 					// from the collection.
-					chanFiles <- l
+					chanFiles <- f
 					break
 				}
 			}
@@ -176,21 +192,28 @@ func getOneDicom(ns_coll string) (chan string) {
 	chanDicoms := make(chan string, MAX_DOWNLOAD_W)
 	chanSync2  := make(chan byte)
 	for i := 0; i < MAX_DOWNLOAD_W ; i++ {
-		go func() {
+		go func(worker int) {
 			for {
 				f, ok := <- chanFiles
 				if ! ok {
 					break
 				}
-				fdicom, err := downloadDicom(f)
+				if ctx.Err() != nil {
+					continue
+				}
+				reporter.workerStart(worker, f.Path)
+				reporter.workerSetSize(worker, f.Size)
+				fdicom, err := downloadDicom(ctx, backend, reporter, worker, cache, f)
+				reporter.workerIdle(worker)
 				if err != nil {
 					log.Error(err)
 					continue
 				}
+				reporter.addFileDone()
 				chanDicoms <- fdicom
 			}
 			chanSync2 <-'0'
-		}()
+		}(i)
 	}
 
 	// closing up chanDicoms
@@ -199,6 +222,7 @@ func getOneDicom(ns_coll string) (chan string) {
 		waitWorkers(MAX_DOWNLOAD_W, &chanSync2)
 		// all workers are finished, closing the channel for downloading/extracting DICOM file
 		close(chanDicoms)
+		reporter.stop()
 	}()
 
 	return chanDicoms
@@ -216,6 +240,33 @@ func waitWorkers(nworker int, chanSync *chan byte) {
 	close(*chanSync)
 }
 
+// irodsFileSep separates the fields packed into a single iquest output line.
+const irodsFileSep = "\x1f"
+
+// irodsFile identifies an iRODS data object together with the metadata used
+// as its dedup cache key, and its size for progress reporting.
+type irodsFile struct {
+	Path     string // COLL_NAME/DATA_NAME
+	Checksum string // DATA_CHECKSUM
+	Mtime    string // DATA_MODIFY_TIME
+	Size     int64  // DATA_SIZE, in bytes
+}
+
+// parseIrodsFile parses a line produced by the iquest format string
+// "%s/%s"+irodsFileSep+"%s"+irodsFileSep+"%s"+irodsFileSep+"%s" (path,
+// checksum, mtime, size) into an irodsFile.
+func parseIrodsFile(line string) (irodsFile, error) {
+	parts := strings.SplitN(line, irodsFileSep, 4)
+	if len(parts) != 4 {
+		return irodsFile{}, errors.New("malformed iquest output: " + line)
+	}
+	size, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return irodsFile{}, errors.New("malformed iquest output: " + line)
+	}
+	return irodsFile{Path: parts[0], Checksum: parts[1], Mtime: parts[2], Size: size}, nil
+}
+
 // isImaFile checks wether the given path has suffix ".IMA".
 func isImaFile(path string) bool {
 	if filepath.Ext(path) == ".IMA" {
@@ -232,104 +283,174 @@ func isZipFile(path string) bool {
 	return false
 }
 
+// isRawDicom tells whether the downloaded file at loc is itself a raw DICOM
+// Part 10 instance, as opposed to an archive to extract from.  It is
+// determined by sniffing loc's content, falling back to the ".IMA" suffix
+// when the content is inconclusive (e.g. the file is empty or not yet
+// flushed) -- the same sniff-then-fallback pattern GetDicomExtractor uses.
+func isRawDicom(loc string) bool {
+	format, err := DetectFormat(loc)
+	if err != nil {
+		log.Warn(fmt.Sprintf("cannot sniff format of %s, falling back to suffix: %s", loc, err))
+		return isImaFile(loc)
+	}
+	if format == FormatDicom {
+		return true
+	}
+	if format == FormatUnknown {
+		return isImaFile(loc)
+	}
+	return false
+}
+
+// downloadAndExtract fetches path from backend into the series-level
+// directory containing loc, and returns the local path of the single DICOM
+// file it yields, plus whether that file is a raw DICOM instance (as
+// opposed to one extracted from an archive).
+//
+// A tar-based archive (tar.gz or tar.zst) is detected by peeking at the
+// first bytes read back from backend.Get, and is piped straight into the
+// extractor without loc ever being written to disk.  A raw DICOM instance,
+// a zip archive, or a download whose format can't be sniffed conclusively
+// falls back to writing loc to disk first, then dispatching on its content
+// the same way GetDicomExtractor and isRawDicom always have.
+func downloadAndExtract(ctx context.Context, backend IRODSBackend, reporter *progressReporter, worker int, path, loc string) (string, bool, error) {
+	pr, pw := io.Pipe()
+	pcw := &workerProgressWriter{w: pw, reporter: reporter, worker: worker}
+
+	getErrCh := make(chan error, 1)
+	go func() {
+		// Get may use its localPath as scratch space and remove it when
+		// done, so it must not be loc, which is written below.
+		err := backend.Get(ctx, path, loc+".part", pcw)
+		pw.CloseWithError(err)
+		getErrCh <- err
+	}()
+	defer func() { <-getErrCh }()
+
+	br := bufio.NewReaderSize(pr, sniffLen)
+	peek, _ := br.Peek(sniffLen)
+	format := detectFormatBytes(peek)
+
+	if format == FormatGzip || format == FormatZstd {
+		fdicom, err := streamExtractTar(format, br, filepath.Dir(loc), path)
+		pr.Close()
+		if err != nil {
+			return "", false, err
+		}
+		return fdicom, false, nil
+	}
+
+	// not a tar-based archive: reconstitute the already in-flight download
+	// to loc on disk, and fall back to the usual content-sniffed dispatch.
+	fo, err := os.Create(loc)
+	if err != nil {
+		pr.CloseWithError(err)
+		return "", false, err
+	}
+	_, copyErr := io.Copy(fo, br)
+	closeErr := fo.Close()
+	if copyErr != nil {
+		os.Remove(loc)
+		return "", false, copyErr
+	}
+	if closeErr != nil {
+		os.Remove(loc)
+		return "", false, closeErr
+	}
+
+	if isRawDicom(loc) {
+		return loc, true, nil
+	}
+
+	fdicom, err := GetDicomExtractor(loc).Extract(loc)
+	if err != nil {
+		return "", false, err
+	}
+	return fdicom, false, nil
+}
+
 // downloadDicom downloads a data object from iRODS, and extracts/saves one DICOM file.
 // On succes, the path of the saved file is returned.
 //
-// This function takes into account the following situations:
+// This function takes into account the following situations, determined by
+// sniffing the content of the downloaded file rather than trusting its name,
+// so an object with an odd or double extension is still handled correctly:
+//
+// 1. the path refers to a 'tar.gz', 'tar.zst' or 'zip' archive.  In this case, one DICOM
+//    file is extracted from the archive.  For 'tar.gz'/'tar.zst', this happens as the bytes
+//    arrive via downloadAndExtract; with the native backend the archive never hits local
+//    disk, while the icommands backend has iget write it to a scratch file first.
 //
-// 1. the path refers to a 'tar.gz' archive.  In this case, one of the DICOM IMA file is
-//    extracted from the archive.
+// 2. the path refers to a raw DICOM instance.  In this case, the file is relocated to the
+//    session folder, rather than the series folder, and stored as it is.
 //
-// 2. the path refers to a DICOM 'IMA' file.  In this case, the 'IMA' file is stored as it is.
+// The transfer is fetched via backend.Get, and is aborted if ctx is cancelled.  Progress of
+// the transfer is reported on reporter's worker-th bar.
 //
-// 3. the path refers to a 'zip' archive.  In this case, the 'zip' file is stored as it is.
-func downloadDicom(path string) (string, error) {
+// Unless --force is given, cache is consulted first: if f was already downloaded/extracted
+// at its current checksum and mtime, and the extracted file still exists, that cached path is
+// returned without touching iRODS.  On a fresh download, cache is updated on success.
+func downloadDicom(ctx context.Context, backend IRODSBackend, reporter *progressReporter, worker int, cache *dedupCache, f irodsFile) (string, error) {
 
-	// download given path from iRODS to a local directory
+	path := f.Path
+
+	if !*opts_force {
+		if cached, ok := cache.lookup(f.Path, f.Checksum, f.Mtime); ok {
+			log.Debug(fmt.Sprintf("cache hit for %s: %s", path, cached))
+			return cached, nil
+		}
+	}
+
+	// download given path from iRODS to the series-level local directory;
+	// a raw DICOM instance is relocated to the session-level directory once
+	// its content is known, below.
 	i := strings.Index(path, *opts_date)
 	if i < 0 {
-		return "", errors.New(fmt.Sprintf("unknown path: %s",path)) 
+		return "", errors.New(fmt.Sprintf("unknown path: %s",path))
 	}
 	loc := filepath.Join(*opts_ddir, *opts_date, path[i+8:])
 
-	if isImaFile(loc) {
-		// for DICOM file, we want it to be copied to the session folder, rather than
-		// the series folder.
-		loc = filepath.Join(filepath.Dir(filepath.Dir(loc)), filepath.Base(loc))
-	}
-
 	dir := filepath.Dir(loc)
 	if err := os.MkdirAll(dir,0755); err != nil {
 		return "", errors.New("cannot create dir: " + dir)
 	}
 
 	log.Debug(fmt.Sprintf("%s -> %s\n", path, loc))
-	c := cmd.NewCmd("iget", "-f", path, loc)
-	st := <- c.Start()
-	if st.Exit != 0 {
-		return "", st.Error
-	}
 
-	// the downloaded file is a zip file containg entire experiment (subject/session)
-	// don't do anything; because we have all the data locally.
-	if isZipFile(loc) {
-		return loc, nil
-	}
-
-	// the downloaded file itself is already a DICOM file
-	if isImaFile(loc) {
-		// make command for downloading full dataset
-		dir_src := filepath.Dir( filepath.Dir(path) )
-		if err := makeDownloadCmd(dir_src, dir); err != nil {
-			log.Warn(fmt.Sprintf("cannot write command: %s\n", err))
-		}
-		return loc, nil
-	}
-
-	// open the gizpped archive: file -> gzip -> tar
-	f, err := os.Open(loc)
-	if err != nil {
-		return "", err
-	}
-	a, err := gzip.NewReader(f)
+	fdicom, isRaw, err := downloadAndExtract(ctx, backend, reporter, worker, path, loc)
 	if err != nil {
 		return "", err
 	}
-	tr := tar.NewReader(a)
 
-	defer func() {
-		a.Close()
-		f.Close()
-		os.Remove(loc)
-	}()
+	if isRaw {
+		// relocate the raw DICOM instance to the session folder, rather
+		// than the series folder.
+		sessionLoc := filepath.Join(filepath.Dir(filepath.Dir(loc)), filepath.Base(fdicom))
+		if err := os.Rename(fdicom, sessionLoc); err != nil {
+			return "", err
+		}
+		fdicom = sessionLoc
 
-	// extracted dicom filename
-	var fdicom string
-	for {
-		h, err := tr.Next()
-		if err == io.EOF {
-			return "", errors.New("empty archive: " + loc)
+		// make command for downloading the full session, not just this series
+		dir_src := filepath.Dir( filepath.Dir(path) )
+		if err := makeDownloadCmd(dir_src, filepath.Dir(fdicom)); err != nil {
+			log.Warn(fmt.Sprintf("cannot write command: %s\n", err))
 		}
-		if h.Typeflag == tar.TypeDir {
-			continue
+		if err := cache.store(f.Path, f.Checksum, f.Mtime, fdicom); err != nil {
+			log.Warn(fmt.Sprintf("cannot update dedup cache: %s", err))
 		}
-		if h.Typeflag == tar.TypeReg {
-			// output file
-			fdicom = filepath.Join(dir, filepath.Base(h.Name))
-
-			if err := copyReaderToPath(tr, fdicom, os.FileMode(h.Mode)); err != nil {
-				return "", err
-			}
-
-			log.Debug(fmt.Sprintf("DICOM file extracted: %s", fdicom))
+		return fdicom, nil
+	}
 
-			// make command for downloading full dataset
-			if err := makeDownloadCmd(filepath.Dir(path), dir); err != nil {
-				log.Warn(fmt.Sprintf("cannot write command: %s\n", err))
-			}
-			return fdicom, nil
-		}
+	// make command for downloading full dataset
+	if err := makeDownloadCmd(filepath.Dir(path), dir); err != nil {
+		log.Warn(fmt.Sprintf("cannot write command: %s\n", err))
+	}
+	if err := cache.store(f.Path, f.Checksum, f.Mtime, fdicom); err != nil {
+		log.Warn(fmt.Sprintf("cannot update dedup cache: %s", err))
 	}
+	return fdicom, nil
 }
 
 
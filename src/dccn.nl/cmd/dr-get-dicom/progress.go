@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cheggaaa/pb/v3"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/term"
+)
+
+// progressReporter drives a pool of pb/v3 progress bars: one per download
+// worker, showing the iRODS path currently being fetched and its transferred
+// bytes, plus one "total" bar counting collections discovered vs. files
+// completed.  It is a no-op when progress reporting is disabled, so callers
+// don't need to branch on whether it is enabled.
+type progressReporter struct {
+	enabled bool
+	pool    *pb.Pool
+	workers []*pb.ProgressBar
+	total   *pb.ProgressBar
+}
+
+// newProgressReporter starts a multi-bar progress pool with one bar per
+// download worker.  It returns a disabled reporter -- whose methods are all
+// no-ops -- when `--no-progress` was given or stderr is not a TTY.
+func newProgressReporter(nworkers int) *progressReporter {
+	if *opts_no_progress || !term.IsTerminal(int(os.Stderr.Fd())) {
+		return &progressReporter{enabled: false}
+	}
+
+	tmpl := `{{string . "prefix"}} {{counters . }} {{bar . }} {{speed . }}`
+	workers := make([]*pb.ProgressBar, nworkers)
+	bars := make([]*pb.ProgressBar, 0, nworkers+1)
+	for i := range workers {
+		workers[i] = pb.ProgressBarTemplate(tmpl).New(0)
+		workers[i].Set("prefix", fmt.Sprintf("worker-%d (idle)", i))
+		bars = append(bars, workers[i])
+	}
+
+	total := pb.ProgressBarTemplate(`{{string . "prefix"}} {{counters . }}`).New(0)
+	total.Set("prefix", "total")
+	bars = append(bars, total)
+
+	pool := pb.NewPool(bars...)
+	if err := pool.Start(); err != nil {
+		log.Warn(fmt.Sprintf("cannot start progress bars, falling back to plain logging: %s", err))
+		return &progressReporter{enabled: false}
+	}
+
+	return &progressReporter{enabled: true, pool: pool, workers: workers, total: total}
+}
+
+// workerStart marks worker i as downloading the given iRODS path.
+func (p *progressReporter) workerStart(i int, path string) {
+	if !p.enabled {
+		return
+	}
+	p.workers[i].SetCurrent(0)
+	p.workers[i].Set("prefix", path)
+}
+
+// workerSetSize sets the known total size of the file worker i is downloading.
+func (p *progressReporter) workerSetSize(i int, size int64) {
+	if !p.enabled {
+		return
+	}
+	p.workers[i].SetTotal(size)
+}
+
+// workerProgress updates the transferred-bytes count of worker i.
+func (p *progressReporter) workerProgress(i int, n int64) {
+	if !p.enabled {
+		return
+	}
+	p.workers[i].SetCurrent(n)
+}
+
+// workerIdle marks worker i as waiting for its next download.
+func (p *progressReporter) workerIdle(i int) {
+	if !p.enabled {
+		return
+	}
+	p.workers[i].SetCurrent(0)
+	p.workers[i].Set("prefix", fmt.Sprintf("worker-%d (idle)", i))
+}
+
+// addCollection increments the number of collections discovered, shown as
+// the total of the "total" bar.
+func (p *progressReporter) addCollection() {
+	if !p.enabled {
+		return
+	}
+	p.total.SetTotal(p.total.Total() + 1)
+}
+
+// addFileDone increments the number of files completed, shown as the
+// current value of the "total" bar.
+func (p *progressReporter) addFileDone() {
+	if !p.enabled {
+		return
+	}
+	p.total.Increment()
+}
+
+// stop finishes and flushes all bars.
+func (p *progressReporter) stop() {
+	if !p.enabled {
+		return
+	}
+	p.pool.Stop()
+}
+
+// workerProgressWriter wraps the io.Writer passed to IRODSBackend.Get so
+// worker i's bar reflects the transferred-byte count as the write side of
+// the transfer sees it, regardless of whether those bytes end up on disk or
+// go straight into an extractor.
+type workerProgressWriter struct {
+	w        io.Writer
+	reporter *progressReporter
+	worker   int
+	n        int64
+}
+
+func (c *workerProgressWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.reporter.workerProgress(c.worker, c.n)
+	return n, err
+}